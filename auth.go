@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Authenticator abstracts password and public-key verification for
+// SshServer, so callers can plug in htpasswd-style files, static maps, or
+// exec-based checkers without touching the SSH plumbing.
+type Authenticator interface {
+	AuthPassword(user, pass string) (bool, error)
+	AuthPublicKey(user string, key ssh.PublicKey) (bool, error)
+}
+
+// AuthorizedKeys authenticates public keys against an OpenSSH
+// authorized_keys file, keyed by SHA256 fingerprint. Every key in the file
+// is trusted for every user; ssh2tcp has no per-user key database of its
+// own.
+type AuthorizedKeys map[string]ssh.PublicKey
+
+// LoadAuthorizedKeys parses path as an OpenSSH authorized_keys file.
+func LoadAuthorizedKeys(path string) (AuthorizedKeys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(AuthorizedKeys)
+	for len(b) > 0 {
+		pk, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		keys[ssh.FingerprintSHA256(pk)] = pk
+		b = rest
+	}
+	return keys, nil
+}
+
+func (a AuthorizedKeys) AuthPublicKey(user string, key ssh.PublicKey) (bool, error) {
+	_, ok := a[ssh.FingerprintSHA256(key)]
+	return ok, nil
+}
+
+func (a AuthorizedKeys) AuthPassword(user, pass string) (bool, error) {
+	return false, nil
+}
+
+// PasswdFile authenticates passwords against an htpasswd-style file: one
+// "user:password" entry per line, where password is either a bcrypt hash
+// (as produced by `htpasswd -B`) or, failing that, compared verbatim.
+type PasswdFile map[string]string
+
+// LoadPasswdFile parses path as a ':'-separated user/password file.
+func LoadPasswdFile(path string) (PasswdFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pf := make(PasswdFile)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pf[parts[0]] = parts[1]
+	}
+	return pf, scanner.Err()
+}
+
+func (p PasswdFile) AuthPassword(user, pass string) (bool, error) {
+	want, ok := p[user]
+	if !ok {
+		return false, nil
+	}
+	if strings.HasPrefix(want, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) == nil, nil
+	}
+	return want == pass, nil
+}
+
+func (p PasswdFile) AuthPublicKey(user string, key ssh.PublicKey) (bool, error) {
+	return false, nil
+}
+
+// MultiAuthenticator tries each Authenticator in turn, succeeding as soon as
+// one of them accepts the credential.
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) AuthPassword(user, pass string) (bool, error) {
+	for _, a := range m {
+		ok, err := a.AuthPassword(user, pass)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m MultiAuthenticator) AuthPublicKey(user string, key ssh.PublicKey) (bool, error) {
+	for _, a := range m {
+		ok, err := a.AuthPublicKey(user, key)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AllowedDestinations restricts which forward destinations a given user may
+// reach, mirroring the AllowedLocalPorts/AllowedRemotePorts model used by
+// go-sshd. A user with no entry is unrestricted.
+type AllowedDestinations map[string][]string
+
+// ParseAllowedDestinations parses the -allowed-dest flag value, formatted as
+// "user=host:port,host:port;user2=host:port".
+func ParseAllowedDestinations(s string) AllowedDestinations {
+	ad := make(AllowedDestinations)
+	if s == "" {
+		return ad
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		ad[kv[0]] = strings.Split(kv[1], ",")
+	}
+	return ad
+}
+
+// Allowed reports whether user may connect to addr. A user absent from the
+// map, or mapped to an empty list, is unrestricted.
+func (a AllowedDestinations) Allowed(user, addr string) bool {
+	if a == nil {
+		return true
+	}
+	dests, ok := a[user]
+	if !ok || len(dests) == 0 {
+		return true
+	}
+	for _, d := range dests {
+		if d == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseAllowedDestinations(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want AllowedDestinations
+	}{
+		{"empty", "", AllowedDestinations{}},
+		{
+			"single user single dest",
+			"alice=10.0.0.1:80",
+			AllowedDestinations{"alice": {"10.0.0.1:80"}},
+		},
+		{
+			"single user multiple dests",
+			"alice=10.0.0.1:80,10.0.0.2:22",
+			AllowedDestinations{"alice": {"10.0.0.1:80", "10.0.0.2:22"}},
+		},
+		{
+			"multiple users",
+			"alice=10.0.0.1:80;bob=10.0.0.2:22,10.0.0.3:22",
+			AllowedDestinations{
+				"alice": {"10.0.0.1:80"},
+				"bob":   {"10.0.0.2:22", "10.0.0.3:22"},
+			},
+		},
+		{
+			"ignores blank entries and malformed entries",
+			"alice=10.0.0.1:80;;noequals;",
+			AllowedDestinations{"alice": {"10.0.0.1:80"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ParseAllowedDestinations(c.in)
+			if len(got) != len(c.want) {
+				t.Fatalf("ParseAllowedDestinations(%q) = %v, want %v", c.in, got, c.want)
+			}
+			for user, dests := range c.want {
+				gotDests, ok := got[user]
+				if !ok || len(gotDests) != len(dests) {
+					t.Fatalf("ParseAllowedDestinations(%q)[%q] = %v, want %v", c.in, user, gotDests, dests)
+				}
+				for i := range dests {
+					if gotDests[i] != dests[i] {
+						t.Fatalf("ParseAllowedDestinations(%q)[%q] = %v, want %v", c.in, user, gotDests, dests)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAllowedDestinationsAllowed(t *testing.T) {
+	ad := AllowedDestinations{
+		"alice": {"10.0.0.1:80", "10.0.0.2:22"},
+		"bob":   {},
+	}
+
+	cases := []struct {
+		name string
+		ad   AllowedDestinations
+		user string
+		addr string
+		want bool
+	}{
+		{"nil map is unrestricted", nil, "alice", "10.0.0.9:9999", true},
+		{"allowed destination", ad, "alice", "10.0.0.1:80", true},
+		{"disallowed destination", ad, "alice", "10.0.0.9:9999", false},
+		{"user with empty list is unrestricted", ad, "bob", "10.0.0.9:9999", true},
+		{"user absent from map is unrestricted", ad, "carol", "10.0.0.9:9999", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.ad.Allowed(c.user, c.addr); got != c.want {
+				t.Errorf("Allowed(%q, %q) = %v, want %v", c.user, c.addr, got, c.want)
+			}
+		})
+	}
+}
+
+func TestPasswdFileAuthPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	pf := PasswdFile{
+		"alice": string(hash),
+		"bob":   "plaintext-pw",
+	}
+
+	cases := []struct {
+		name    string
+		user    string
+		pass    string
+		want    bool
+		wantErr bool
+	}{
+		{"bcrypt hash match", "alice", "s3cret", true, false},
+		{"bcrypt hash mismatch", "alice", "wrong", false, false},
+		{"plaintext match", "bob", "plaintext-pw", true, false},
+		{"plaintext mismatch", "bob", "wrong", false, false},
+		{"unknown user", "carol", "anything", false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := pf.AuthPassword(c.user, c.pass)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("AuthPassword(%q, %q) error = %v, wantErr %v", c.user, c.pass, err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("AuthPassword(%q, %q) = %v, want %v", c.user, c.pass, got, c.want)
+			}
+		})
+	}
+}
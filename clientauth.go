@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ClientAuthMethods builds the ssh.AuthMethod chain for an outgoing SSH
+// connection, trying an ssh-agent (if SSH_AUTH_SOCK is set), then a private
+// key file (if identityPath is set), then falling back to password,
+// matching standard OpenSSH client ordering.
+func ClientAuthMethods(identityPath, password string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if am, err := agentAuthMethod(); err == nil {
+		methods = append(methods, am)
+	} else if os.Getenv("SSH_AUTH_SOCK") != "" {
+		lg.Warn("Unable to use ssh-agent", zap.Error(err))
+	}
+	if identityPath != "" {
+		am, err := identityAuthMethod(identityPath)
+		if err != nil {
+			lg.Warn("Unable to load identity file", zap.String("path", identityPath), zap.Error(err))
+		} else {
+			methods = append(methods, am)
+		}
+	}
+	return append(methods, ssh.Password(password))
+}
+
+func agentAuthMethod() (ssh.AuthMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+}
+
+// identityAuthMethod loads a private key file, using the
+// SSH2TCP_IDENTITY_PASSPHRASE environment variable to decrypt it if it is
+// encrypted.
+func identityAuthMethod(path string) (ssh.AuthMethod, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if _, missing := err.(*ssh.PassphraseMissingError); missing {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(os.Getenv("SSH2TCP_IDENTITY_PASSPHRASE")))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// HostKeyCallback builds an ssh.HostKeyCallback from a known_hosts file. A
+// host key that is not already recorded is trusted on first use and
+// appended to the file (TOFU), mirroring the prompt-and-remember behaviour
+// of the OpenSSH client without requiring an interactive terminal. Every
+// call is first verified against the entries read from the file when the
+// callback was built. Hosts trusted on first use since then are remembered
+// in memory with their key, so a repeat connection with the same key (eg.
+// across SshClient transport redials) does not append a duplicate entry,
+// and a different key for such a host is rejected.
+func HostKeyCallback(path string) (ssh.HostKeyCallback, error) {
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		cb = nil
+	}
+
+	var mu sync.Mutex
+	trusted := make(map[string]string) // hostname -> SHA256 fingerprint
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if cb != nil {
+			err := cb(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if err == nil || !(errors.As(err, &keyErr) && len(keyErr.Want) == 0) {
+				return err
+			}
+		}
+
+		fp := ssh.FingerprintSHA256(key)
+		mu.Lock()
+		defer mu.Unlock()
+		if want, ok := trusted[hostname]; ok {
+			if want == fp {
+				return nil
+			}
+			return fmt.Errorf("knownhosts: host key for %s changed since it was trusted on first use", hostname)
+		}
+		if err := appendKnownHost(path, hostname, key); err != nil {
+			return err
+		}
+		trusted[hostname] = fp
+		return nil
+	}, nil
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lg.Warn("Trusting new SSH host key (TOFU)", zap.String("host", hostname))
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
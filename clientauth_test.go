@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey: %v", err)
+	}
+	return sshPub
+}
+
+func TestHostKeyCallbackTOFU(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "known_hosts")
+
+	cb, err := HostKeyCallback(path)
+	if err != nil {
+		t.Fatalf("HostKeyCallback: %v", err)
+	}
+
+	key1 := newTestPublicKey(t)
+	if err := cb("example.com:22", &net.TCPAddr{}, key1); err != nil {
+		t.Fatalf("first connect to new host should be trusted on first use, got: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading known_hosts: %v", err)
+	}
+	if len(b) == 0 {
+		t.Fatal("expected known host key to be appended to known_hosts file")
+	}
+
+	if err := cb("example.com:22", &net.TCPAddr{}, key1); err != nil {
+		t.Fatalf("reconnecting with the same key should still be trusted, got: %v", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading known_hosts: %v", err)
+	}
+	if string(after) != string(b) {
+		t.Fatal("reconnecting with an already-trusted key should not append a duplicate entry")
+	}
+
+	key2 := newTestPublicKey(t)
+	if err := cb("example.com:22", &net.TCPAddr{}, key2); err == nil {
+		t.Fatal("a different key presented for an already-trusted host must be rejected, not silently accepted")
+	}
+}
+
+func TestHostKeyCallbackDistinctHosts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "known_hosts")
+
+	cb, err := HostKeyCallback(path)
+	if err != nil {
+		t.Fatalf("HostKeyCallback: %v", err)
+	}
+
+	keyA := newTestPublicKey(t)
+	keyB := newTestPublicKey(t)
+	if err := cb("host-a:22", &net.TCPAddr{}, keyA); err != nil {
+		t.Fatalf("trust host-a: %v", err)
+	}
+	if err := cb("host-b:22", &net.TCPAddr{}, keyB); err != nil {
+		t.Fatalf("a different, previously-unseen host with a different key should also be trusted on first use: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// SOCKS5 listener and upstream client (RFC 1928). Only the CONNECT command
+// is supported; BIND and UDP ASSOCIATE are not implemented.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth    = 0x00
+	socks5MethodUserPass  = 0x02
+	socks5MethodNoAccept  = 0xff
+	socks5UserPassVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded = 0x00
+	socks5RepFailure   = 0x01
+)
+
+// Socks5Server accepts SOCKS5 CONNECT requests and emits an
+// AddressedDataChannel per connection carrying the requested destination,
+// so a dynamic Client can forward to it via ConnectTo.
+type Socks5Server struct {
+	lnr  net.Listener
+	addr string
+	user string
+	pass string
+}
+
+func (s *Socks5Server) Listen() error {
+	var err error
+	s.lnr, err = net.Listen("tcp", s.addr)
+	return err
+}
+
+func (s *Socks5Server) Accept(dcs chan<- interface{}) error {
+	conn, err := s.lnr.Accept()
+	if err != nil {
+		lg.Warn("Accept() failed")
+		return err
+	}
+	go func() {
+		addr, err := s.handshake(conn)
+		if err != nil {
+			lg.Debug("SOCKS5 handshake failed", zap.Error(err))
+			conn.Close()
+			return
+		}
+		lg.Debug("New SOCKS5 connection", zap.String("target", addr))
+		dc, ok := conn.(DataChannel)
+		if !ok {
+			conn.Close()
+			return
+		}
+		dcs <- AddressedDataChannel{DataChannel: dc, Addr: addr}
+	}()
+	return nil
+}
+
+func (s *Socks5Server) Close() error {
+	return s.lnr.Close()
+}
+
+// handshake negotiates the method, optionally authenticates, and parses a
+// CONNECT request, returning the requested "host:port" destination.
+func (s *Socks5Server) handshake(conn net.Conn) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5MethodNoAccept)
+	for _, m := range methods {
+		if s.user != "" && m == socks5MethodUserPass {
+			method = socks5MethodUserPass
+			break
+		}
+		if s.user == "" && m == socks5MethodNoAuth {
+			method = socks5MethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5MethodNoAccept {
+		return "", errors.New("no acceptable authentication method")
+	}
+	if method == socks5MethodUserPass {
+		if err := s.authUserPass(conn); err != nil {
+			return "", err
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version || req[1] != socks5CmdConnect {
+		s.reply(conn, socks5RepFailure)
+		return "", fmt.Errorf("unsupported SOCKS5 command %d", req[1])
+	}
+
+	host, err := readSocks5Addr(conn, req[3])
+	if err != nil {
+		s.reply(conn, socks5RepFailure)
+		return "", err
+	}
+	portB := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portB); err != nil {
+		return "", err
+	}
+
+	if err := s.reply(conn, socks5RepSucceeded); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portB)))), nil
+}
+
+func (s *Socks5Server) authUserPass(conn net.Conn) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	uname := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return err
+	}
+	passwd := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return err
+	}
+	ok := string(uname) == s.user && string(passwd) == s.pass
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	if _, err := conn.Write([]byte{socks5UserPassVersion, status}); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid SOCKS5 credentials")
+	}
+	return nil
+}
+
+func (s *Socks5Server) reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// readSocks5Addr reads the address portion of a SOCKS5 request or reply for
+// the given address type.
+func readSocks5Addr(conn net.Conn, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		return net.IP(b).String(), nil
+	case socks5AtypIPv6:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		return net.IP(b).String(), nil
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", atyp)
+	}
+}
+
+// Socks5Client dials a destination through an upstream SOCKS5 proxy, for
+// chaining ssh2tcp behind another dynamic-forward tool.
+type Socks5Client struct {
+	proxyAddr string
+	target    string
+	user      string
+	pass      string
+}
+
+func (c *Socks5Client) Connect() (DataChannel, error) {
+	return c.ConnectTo(c.target)
+}
+
+func (c *Socks5Client) ConnectTo(addr string) (DataChannel, error) {
+	conn, err := net.Dial("tcp", c.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.connectThroughProxy(conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	lg.Debug("SOCKS5 upstream connected", zap.String("proxy", c.proxyAddr), zap.String("target", addr))
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn, nil
+}
+
+func (c *Socks5Client) Close() error {
+	return nil
+}
+
+func (c *Socks5Client) connectThroughProxy(conn net.Conn, target string) error {
+	methods := []byte{socks5MethodNoAuth}
+	if c.user != "" {
+		methods = []byte{socks5MethodUserPass}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d in proxy reply", resp[0])
+	}
+	switch resp[1] {
+	case socks5MethodUserPass:
+		if err := c.authUserPass(conn); err != nil {
+			return err
+		}
+	case socks5MethodNoAuth:
+	default:
+		return errors.New("SOCKS5 proxy rejected all authentication methods")
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	req := append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain, byte(len(host))}, []byte(host)...)
+	portB := make([]byte, 2)
+	binary.BigEndian.PutUint16(portB, uint16(port))
+	req = append(req, portB...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	if hdr[1] != socks5RepSucceeded {
+		return fmt.Errorf("SOCKS5 proxy refused CONNECT: code %d", hdr[1])
+	}
+	if _, err := readSocks5Addr(conn, hdr[3]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Socks5Client) authUserPass(conn net.Conn) error {
+	req := []byte{socks5UserPassVersion, byte(len(c.user))}
+	req = append(req, []byte(c.user)...)
+	req = append(req, byte(len(c.pass)))
+	req = append(req, []byte(c.pass)...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return errors.New("SOCKS5 proxy rejected credentials")
+	}
+	return nil
+}
@@ -1,86 +1,189 @@
 package main
 
 import (
-	"io"
+	"errors"
+	"fmt"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
 
 // SSH client and server
+
+const (
+	sshDialMaxAttempts    = 5
+	sshDialInitialBackoff = 500 * time.Millisecond
+	sshDialMaxBackoff     = 30 * time.Second
+	sshKeepaliveInterval  = 30 * time.Second
+)
+
+// keepalive periodically sends a keepalive@openssh.com global request on cc
+// to detect a dead peer faster than a subsequent direct-tcpip dial would.
+// onDead is called once, with cc's mutex-guarded owner expected to drop its
+// reference so the next caller reconnects.
+func keepalive(cc *ssh.Client, onDead func()) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, _, err := cc.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			lg.Debug("SSH keepalive failed, dropping connection", zap.Error(err))
+			onDead()
+			cc.Close()
+			return
+		}
+	}
+}
+
+// closeWriter is implemented by the net.Conn returned for a direct-tcpip
+// channel, letting us signal EOF on the write side without tearing down the
+// whole channel.
+type closeWriter interface {
+	CloseWrite() error
+}
+
 type SshClientDataChannel struct {
-	sess *ssh.Session
-	rdc  io.Reader
-	wrc  io.WriteCloser
+	conn net.Conn
+	cwc  closeWriter
 }
 
 func (sdc SshClientDataChannel) Read(data []byte) (int, error) {
-	return sdc.rdc.Read(data)
+	return sdc.conn.Read(data)
 }
 
 func (sdc SshClientDataChannel) Write(data []byte) (int, error) {
-	return sdc.wrc.Write(data)
+	return sdc.conn.Write(data)
 }
 
 func (sdc SshClientDataChannel) Close() error {
-	return sdc.sess.Close()
+	return sdc.conn.Close()
 }
 
 func (sdc SshClientDataChannel) CloseWrite() error {
-	return sdc.wrc.Close()
+	return sdc.cwc.CloseWrite()
 }
 
+// SshClient keeps one long-lived *ssh.Client transport to addr and opens a
+// fresh direct-tcpip channel on it for every Connect()/ConnectTo() call,
+// instead of paying for a full TCP+SSH handshake per stream. The transport
+// is redialled with backoff if it has died since the last use.
 type SshClient struct {
-	est  bool
-	dc   SshClientDataChannel
-	addr string
-	cfg  ssh.ClientConfig
+	mu     sync.Mutex
+	cc     *ssh.Client
+	addr   string // SSH server to dial
+	target string // host:port requested via the direct-tcpip channel
+	cfg    ssh.ClientConfig
 }
 
 func (c *SshClient) Connect() (DataChannel, error) {
-	c.est = false
-	lg.Debug("Setting up SSH client connection", zap.String("remote", c.addr))
-	cc, err := ssh.Dial("tcp", c.addr, &c.cfg)
+	return c.dial(c.target)
+}
+
+func (c *SshClient) ConnectTo(addr string) (DataChannel, error) {
+	return c.dial(addr)
+}
+
+func (c *SshClient) dial(target string) (DataChannel, error) {
+	cc, err := c.transport()
 	if err != nil {
 		lg.Debug("Unable to establish SSH connection", zap.Error(err))
 		return nil, err
 	}
-	c.dc.sess, err = cc.NewSession()
+	lg.Debug("Opening direct-tcpip channel", zap.String("target", target))
+	conn, err := cc.Dial("tcp", target)
 	if err != nil {
-		lg.Debug("Unable to get new SSH client session")
+		lg.Debug("Unable to open direct-tcpip channel", zap.Error(err))
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) {
+			// Not a per-channel rejection (eg. the target refused the
+			// connection) but a transport-level failure, so the shared
+			// *ssh.Client is assumed dead and will be redialled on next use.
+			c.dropTransport(cc)
+		}
 		return nil, err
 	}
-	c.est = true
-	c.dc.rdc, err = c.dc.sess.StdoutPipe()
-	if err != nil {
-		lg.Debug("Unable to get read channel")
-		return nil, err
+	cwc, ok := conn.(closeWriter)
+	if !ok {
+		return nil, errors.New("direct-tcpip channel does not support CloseWrite")
+	}
+	return SshClientDataChannel{conn: conn, cwc: cwc}, nil
+}
+
+// transport returns the shared *ssh.Client, (re)dialling it with
+// exponential backoff if it is not currently established.
+func (c *SshClient) transport() (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cc != nil {
+		return c.cc, nil
+	}
+
+	lg.Debug("Setting up SSH client connection", zap.String("remote", c.addr))
+	backoff := sshDialInitialBackoff
+	var cc *ssh.Client
+	var err error
+	for attempt := 1; attempt <= sshDialMaxAttempts; attempt++ {
+		cc, err = ssh.Dial("tcp", c.addr, &c.cfg)
+		if err == nil {
+			break
+		}
+		if attempt == sshDialMaxAttempts {
+			break
+		}
+		lg.Debug("SSH dial failed, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > sshDialMaxBackoff {
+			backoff = sshDialMaxBackoff
+		}
 	}
-	c.dc.wrc, err = c.dc.sess.StdinPipe()
 	if err != nil {
-		lg.Debug("Unable to get write channel")
 		return nil, err
 	}
 
-	err = c.dc.sess.Shell()
+	c.cc = cc
+	go keepalive(cc, func() { c.dropTransport(cc) })
+	return cc, nil
+}
 
-	return c.dc, nil
+// dropTransport clears c.cc if it still points at cc, so the next dial()
+// reconnects instead of reusing a known-dead client.
+func (c *SshClient) dropTransport(cc *ssh.Client) {
+	c.mu.Lock()
+	if c.cc == cc {
+		c.cc = nil
+	}
+	c.mu.Unlock()
 }
 
 func (c *SshClient) Close() error {
-	if c.est {
-		c.est = false
-		return c.dc.Close()
+	c.mu.Lock()
+	cc := c.cc
+	c.cc = nil
+	c.mu.Unlock()
+	if cc == nil {
+		return nil
 	}
-	return nil
+	return cc.Close()
 }
 
 type SshServer struct {
-	lnr  net.Listener
-	addr string
-	cfg  ssh.ServerConfig
+	lnr     net.Listener
+	addr    string
+	cfg     ssh.ServerConfig
+	auth    Authenticator
+	allowed AllowedDestinations
+}
+
+// directTcpipExtraData is the RFC 4254 7.2 channel-open payload for
+// "direct-tcpip" channels.
+type directTcpipExtraData struct {
+	HostToConnect       string
+	PortToConnect       uint32
+	OriginatorIPAddress string
+	OriginatorPort      uint32
 }
 
 func (s *SshServer) Listen() error {
@@ -95,32 +198,43 @@ func (s *SshServer) Accept(dcs chan<- interface{}) error {
 		lg.Warn("Accept() failed")
 		return err
 	}
-	_, chans, reqs, err := ssh.NewServerConn(tcpConn, &s.cfg)
+	conn, chans, reqs, err := ssh.NewServerConn(tcpConn, &s.cfg)
+	if err != nil {
+		lg.Debug("SSH handshake failed", zap.Error(err))
+		return nil
+	}
+	var user string
+	if conn.Permissions != nil {
+		user = conn.Permissions.Extensions["user"]
+	}
 	go ssh.DiscardRequests(reqs)
 	go func() {
 		for newChannel := range chans {
+			if newChannel.ChannelType() != "direct-tcpip" {
+				lg.Debug("Rejecting channel", zap.String("type", newChannel.ChannelType()))
+				newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip channels are supported")
+				continue
+			}
+			var data directTcpipExtraData
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &data); err != nil {
+				lg.Debug("Unable to parse direct-tcpip request")
+				newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+				continue
+			}
+			target := fmt.Sprintf("%s:%d", data.HostToConnect, data.PortToConnect)
+			if !s.allowed.Allowed(user, target) {
+				lg.Debug("Rejecting direct-tcpip channel to disallowed destination", zap.String("user", user), zap.String("target", target))
+				newChannel.Reject(ssh.Prohibited, "destination not allowed for this user")
+				continue
+			}
 			connection, requests, err := newChannel.Accept()
 			if err != nil {
 				lg.Debug("Unable to accept channel")
 				continue
 			}
-			lg.Debug("New channel accepted")
-			dcs <- connection
-			go func() {
-				for req := range requests {
-					lg.Debug("Request received", zap.String("request", req.Type), zap.String("want-reply", strconv.FormatBool(req.WantReply)))
-					switch req.Type {
-					case "exec":
-						req.Reply(true, nil)
-					case "shell":
-						req.Reply(true, nil)
-					case "pty-req":
-						req.Reply(true, nil)
-					case "window-change":
-						req.Reply(true, nil)
-					}
-				}
-			}()
+			lg.Debug("New direct-tcpip channel accepted", zap.String("requested", target))
+			go ssh.DiscardRequests(requests)
+			dcs <- AddressedDataChannel{DataChannel: connection, Addr: target}
 		}
 	}()
 	return nil
@@ -129,3 +243,97 @@ func (s *SshServer) Accept(dcs chan<- interface{}) error {
 func (s *SshServer) Close() error {
 	return s.lnr.Close()
 }
+
+// tcpipForwardMsg is the RFC 4254 7.1 "tcpip-forward" global-request
+// payload.
+type tcpipForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpipForwardReply carries the bound port when BindPort is 0 in the
+// request and the server picks one.
+type tcpipForwardReply struct {
+	Port uint32
+}
+
+// forwardedTcpipExtraData is the RFC 4254 7.2 channel-open payload for
+// "forwarded-tcpip" channels.
+type forwardedTcpipExtraData struct {
+	BindAddr            string
+	BindPort            uint32
+	OriginatorIPAddress string
+	OriginatorPort      uint32
+}
+
+// SshReverseServer connects out to an SSH server and requests a
+// tcpip-forward remote port forward, then hands each inbound
+// forwarded-tcpip channel to the caller as if it had been accepted
+// locally. This supports NAT-traversal (frp/chisel-style reverse
+// tunneling) with the listen-only transports.
+type SshReverseServer struct {
+	addr     string // SSH server to dial
+	bindAddr string
+	bindPort uint32
+	cfg      ssh.ClientConfig
+	client   *ssh.Client
+	chans    <-chan ssh.NewChannel
+}
+
+func (s *SshReverseServer) Listen() error {
+	cc, err := ssh.Dial("tcp", s.addr, &s.cfg)
+	if err != nil {
+		return err
+	}
+	s.client = cc
+	s.chans = cc.HandleChannelOpen("forwarded-tcpip")
+
+	payload := ssh.Marshal(&tcpipForwardMsg{BindAddr: s.bindAddr, BindPort: s.bindPort})
+	ok, reply, err := cc.SendRequest("tcpip-forward", true, payload)
+	if err != nil {
+		cc.Close()
+		return err
+	}
+	if !ok {
+		cc.Close()
+		return errors.New("tcpip-forward request rejected by remote SSH server")
+	}
+	if s.bindPort == 0 {
+		var r tcpipForwardReply
+		if err := ssh.Unmarshal(reply, &r); err == nil {
+			s.bindPort = r.Port
+		}
+	}
+	lg.Debug("Reverse tunnel established", zap.String("bind", fmt.Sprintf("%s:%d", s.bindAddr, s.bindPort)))
+	go keepalive(cc, func() {})
+	return nil
+}
+
+func (s *SshReverseServer) Accept(dcs chan<- interface{}) error {
+	newChannel, ok := <-s.chans
+	if !ok {
+		return errors.New("SSH connection to remote forwarder closed")
+	}
+	var data forwardedTcpipExtraData
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &data); err != nil {
+		lg.Debug("Unable to parse forwarded-tcpip request")
+		newChannel.Reject(ssh.ConnectionFailed, "malformed forwarded-tcpip request")
+		return nil
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		lg.Debug("Unable to accept forwarded-tcpip channel")
+		return nil
+	}
+	lg.Debug("New forwarded-tcpip channel accepted", zap.String("originator", fmt.Sprintf("%s:%d", data.OriginatorIPAddress, data.OriginatorPort)))
+	go ssh.DiscardRequests(requests)
+	dcs <- channel
+	return nil
+}
+
+func (s *SshReverseServer) Close() error {
+	if s.client != nil {
+		return s.client.Close()
+	}
+	return nil
+}
@@ -18,14 +18,22 @@ type TcpClient struct {
 }
 
 func (c *TcpClient) Connect() (DataChannel, error) {
-	cc, err := net.Dial("tcp", c.addr)
-	ctcp, _ := cc.(*net.TCPConn)
+	return c.dial(c.addr)
+}
+
+func (c *TcpClient) ConnectTo(addr string) (DataChannel, error) {
+	return c.dial(addr)
+}
+
+func (c *TcpClient) dial(addr string) (DataChannel, error) {
+	cc, err := net.Dial("tcp", addr)
 	if err != nil {
-		lg.Debug("TCP connection failed", zap.String("remote", cc.RemoteAddr().String()))
-	} else {
-		lg.Debug("TCP connected", zap.String("remote", cc.RemoteAddr().String()))
+		lg.Debug("TCP connection failed", zap.String("remote", addr), zap.Error(err))
+		return nil, err
 	}
-	return ctcp, err
+	lg.Debug("TCP connected", zap.String("remote", cc.RemoteAddr().String()))
+	ctcp, _ := cc.(*net.TCPConn)
+	return ctcp, nil
 }
 
 func (c *TcpClient) Close() error {